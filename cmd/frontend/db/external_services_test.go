@@ -31,6 +31,36 @@ func TestExternalServices_ValidateConfig(t *testing.T) {
 			config: `{"region": "eu-west-2", "accessKeyID": "bar", "secretAccessKey": "baz"}`,
 			err:    ``,
 		},
+		{
+			kind:   "GITLAB",
+			desc:   "sudo authorization without token",
+			config: `{"url": "https://gitlab.example.com", "token": "t", "authorization": {"sudo": {"identityProvider": {"serviceID": "https://sso.example.com"}}}}`,
+			err:    `authorization.sudo: token is required; `,
+		},
+		{
+			kind:   "GITLAB",
+			desc:   "sudo authorization without identityProvider",
+			config: `{"url": "https://gitlab.example.com", "token": "t", "authorization": {"sudo": {"token": "admin-pat"}}}`,
+			err:    `authorization.sudo: identityProvider is required; `,
+		},
+		{
+			kind:   "GITLAB",
+			desc:   "valid sudo authorization",
+			config: `{"url": "https://gitlab.example.com", "token": "t", "authorization": {"sudo": {"token": "admin-pat", "identityProvider": {"serviceID": "https://sso.example.com"}}}}`,
+			err:    ``,
+		},
+		{
+			kind:   "GITLAB",
+			desc:   "tls with malformed certificateAuthority PEM",
+			config: `{"url": "https://gitlab.example.com", "token": "t", "tls": {"certificateAuthority": "not a pem"}}`,
+			err:    `tls.certificateAuthority: tls.certificateAuthority must be a valid PEM-encoded certificate bundle; `,
+		},
+		{
+			kind:   "GITLAB",
+			desc:   "tls with clientCertificate but no clientKey",
+			config: `{"url": "https://gitlab.example.com", "token": "t", "tls": {"clientCertificate": "-----BEGIN CERTIFICATE-----\n...\n-----END CERTIFICATE-----"}}`,
+			err:    `tls: clientKey is required; `,
+		},
 		{
 			kind:   "BITBUCKETSERVER",
 			desc:   "without url",
@@ -0,0 +1,165 @@
+package gitlab
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/pkg/extsvc/gitlab"
+)
+
+// cache is the key-value store backing the authz provider's cached permissions data. It is
+// implemented by *rcache.Cache in production and mocked out in tests.
+type cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, b []byte)
+	Delete(key string)
+}
+
+type repoVisibilityCacheVal struct {
+	Visibility gitlab.Visibility
+	TTL        time.Duration
+
+	// NotFound is true only once a project's deletion has been confirmed through a lookup that
+	// can't be explained by per-viewer visibility (e.g. an admin/PAT-authenticated check). A 404
+	// from a single user's or anonymous token is not sufficient, since GitLab returns the same 404
+	// for a private or internal project as for one that's gone; nothing currently sets this field.
+	NotFound bool
+}
+
+type userRepoCacheVal struct {
+	Read bool
+	TTL  time.Duration
+}
+
+// userGroupsCacheVal caches the full list of groups (>=Reporter access) a user belongs to, keyed
+// by accountID, so that fetchUserGroups can skip the GitLab /groups round trip entirely on a
+// cache hit rather than re-requesting it on every RepoPerms call.
+type userGroupsCacheVal struct {
+	Groups []*gitlab.Group
+	TTL    time.Duration
+}
+
+func repoVisibilityCacheKey(projID int) string {
+	return "v:" + strconv.Itoa(projID)
+}
+
+func userRepoCacheKey(accountID string, projID int) string {
+	return "r:" + accountID + ":" + strconv.Itoa(projID)
+}
+
+func userGroupsCacheKey(accountID string) string {
+	return "g:" + accountID
+}
+
+func cacheGetRepoVisibility(c cache, projID int, ttl time.Duration) (repoVisibilityCacheVal, bool) {
+	var v repoVisibilityCacheVal
+	b, exists := c.Get(repoVisibilityCacheKey(projID))
+	if !exists {
+		return v, false
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return v, false
+	}
+	if v.TTL != ttl {
+		// The configured TTL has changed since this entry was cached; treat it as stale.
+		return v, false
+	}
+	return v, true
+}
+
+func cacheSetRepoVisibility(c cache, projID int, v repoVisibilityCacheVal) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal repo visibility cache value")
+	}
+	c.Set(repoVisibilityCacheKey(projID), b)
+	return nil
+}
+
+func cacheGetUserRepo(c cache, accountID string, projID int, ttl time.Duration) (userRepoCacheVal, bool) {
+	var v userRepoCacheVal
+	b, exists := c.Get(userRepoCacheKey(accountID, projID))
+	if !exists {
+		return v, false
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return v, false
+	}
+	if v.TTL != ttl {
+		return v, false
+	}
+	return v, true
+}
+
+func cacheSetUserRepo(c cache, accountID string, projID int, v userRepoCacheVal) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal user repo cache value")
+	}
+	c.Set(userRepoCacheKey(accountID, projID), b)
+	if !v.Read {
+		cacheOpsCounter.WithLabelValues("write", "negative").Inc()
+	}
+	return nil
+}
+
+func cacheGetUserGroups(c cache, accountID string, ttl time.Duration) ([]*gitlab.Group, bool) {
+	var v userGroupsCacheVal
+	b, exists := c.Get(userGroupsCacheKey(accountID))
+	if !exists {
+		return nil, false
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, false
+	}
+	if v.TTL != ttl {
+		return nil, false
+	}
+	return v.Groups, true
+}
+
+func cacheSetUserGroups(c cache, accountID string, v userGroupsCacheVal) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal user groups cache value")
+	}
+	c.Set(userGroupsCacheKey(accountID), b)
+	return nil
+}
+
+// sudoUserProjectsCacheVal caches the full set of project IDs a GitLab user (identified by the
+// username or ID GitLab is asked to impersonate via Sudo) can access.
+type sudoUserProjectsCacheVal struct {
+	ProjectIDs []int
+	TTL        time.Duration
+}
+
+func sudoUserProjectsCacheKey(sudo string) string {
+	return "s:" + sudo
+}
+
+func cacheGetSudoUserProjects(c cache, sudo string, ttl time.Duration) ([]int, bool) {
+	var v sudoUserProjectsCacheVal
+	b, exists := c.Get(sudoUserProjectsCacheKey(sudo))
+	if !exists {
+		return nil, false
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, false
+	}
+	if v.TTL != ttl {
+		return nil, false
+	}
+	return v.ProjectIDs, true
+}
+
+func cacheSetSudoUserProjects(c cache, sudo string, v sudoUserProjectsCacheVal) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal Sudo user projects cache value")
+	}
+	c.Set(sudoUserProjectsCacheKey(sudo), b)
+	return nil
+}
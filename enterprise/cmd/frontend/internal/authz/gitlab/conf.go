@@ -0,0 +1,126 @@
+package gitlab
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/pkg/conf"
+	"github.com/sourcegraph/sourcegraph/schema"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+func init() {
+	go func() {
+		conf.Watch(func() {
+			providers, _ := parseSudoConfig(conf.Get())
+			authz.UpdateProviders("gitlabAuthzSudo", providers)
+		})
+		conf.ContributeValidator(func(cfg conf.Unified) (problems []string) {
+			_, problems = parseSudoConfig(&cfg)
+			return problems
+		})
+	}()
+}
+
+// ConfiguredProvider pairs a running OAuth GitLab authz provider with the identifying/webhook
+// details the background perms-sync subsystem (package sync) needs, but that the provider itself
+// has no reason to expose.
+type ConfiguredProvider struct {
+	ServiceID     string
+	ServiceType   string
+	WebhookSecret string
+	Provider      *GitLabOAuthAuthzProvider
+}
+
+// ConfiguredProviders builds a GitLabOAuthAuthzProvider for every GitLab external service config
+// entry that does not opt into Sudo mode (see parseSudoConfig), for use by the perms-sync
+// subsystem, which needs direct access to the provider to warm its cache and invalidate cache
+// entries from webhook events.
+func ConfiguredProviders(cfg *conf.Unified) (cps []ConfiguredProvider, problems []string) {
+	for _, svc := range cfg.Critical.ExternalServices {
+		if svc.Authorization != nil && svc.Authorization.Sudo != nil {
+			continue
+		}
+
+		baseURL, err := url.Parse(svc.Url)
+		if err != nil {
+			problems = append(problems, "Could not parse `url` for GitLab external service: "+err.Error())
+			continue
+		}
+
+		p, err := NewProvider(GitLabOAuthAuthzProviderOp{
+			BaseURL:   baseURL,
+			CacheTTL:  3 * time.Hour,
+			TLSConfig: svc.Tls,
+		})
+		if err != nil {
+			problems = append(problems, "Could not construct GitLab authz provider: "+err.Error())
+			continue
+		}
+
+		var webhookSecret string
+		if svc.Webhooks != nil {
+			webhookSecret = svc.Webhooks.Secret
+		}
+		cps = append(cps, ConfiguredProvider{
+			ServiceID:     p.ServiceID(),
+			ServiceType:   p.ServiceType(),
+			WebhookSecret: webhookSecret,
+			Provider:      p,
+		})
+	}
+	return cps, problems
+}
+
+// parseSudoConfig builds a GitLabSudoAuthzProvider for every GitLab authorization config entry
+// that opts into Sudo/impersonation-token mode via `authorization.sudo`, instead of the default
+// per-user OAuth mode.
+func parseSudoConfig(cfg *conf.Unified) (providers []authz.Provider, problems []string) {
+	for _, svc := range cfg.Critical.ExternalServices {
+		if svc.Authorization == nil || svc.Authorization.Sudo == nil {
+			continue
+		}
+		sudoCfg := svc.Authorization.Sudo
+
+		baseURL, err := url.Parse(svc.Url)
+		if err != nil {
+			problems = append(problems, "Could not parse `url` for GitLab external service: "+err.Error())
+			continue
+		}
+		if sudoCfg.Token == "" {
+			problems = append(problems, "authorization.sudo.token: authorization.sudo.token is required; ")
+			continue
+		}
+		if sudoCfg.IdentityProvider == nil {
+			problems = append(problems, "authorization.sudo.identityProvider: authorization.sudo.identityProvider is required; ")
+			continue
+		}
+
+		mapper, err := newIdentityMapper(sudoCfg.IdentityProvider)
+		if err != nil {
+			problems = append(problems, "Could not construct GitLab Sudo identity mapper: "+err.Error())
+			continue
+		}
+
+		ttl, err := time.ParseDuration(sudoCfg.Ttl)
+		if err != nil {
+			ttl = 3 * time.Hour
+			log15.Warn("Invalid GitLab authorization.sudo.ttl, using default", "default", ttl, "error", err)
+		}
+
+		p, err := NewSudoProvider(GitLabSudoAuthzProviderOp{
+			BaseURL:        baseURL,
+			SudoToken:      sudoCfg.Token,
+			IdentityMapper: mapper,
+			CacheTTL:       ttl,
+			TLSConfig:      svc.Tls,
+		})
+		if err != nil {
+			problems = append(problems, "Could not construct GitLab Sudo authz provider: "+err.Error())
+			continue
+		}
+		providers = append(providers, p)
+	}
+	return providers, problems
+}
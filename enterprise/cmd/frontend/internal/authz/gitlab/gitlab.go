@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -19,9 +21,25 @@ import (
 	"github.com/sourcegraph/sourcegraph/pkg/extsvc"
 	"github.com/sourcegraph/sourcegraph/pkg/extsvc/gitlab"
 	"github.com/sourcegraph/sourcegraph/pkg/rcache"
+	"github.com/sourcegraph/sourcegraph/schema"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 	log15 "gopkg.in/inconshreveable/log15.v2"
 )
 
+// maxGraphQLBatchSize is the maximum number of projects GitLab's GraphQL API will resolve in a
+// single `projects(ids: [...])` query.
+const maxGraphQLBatchSize = 100
+
+// maxFallbackConcurrency bounds how many REST fetchProjVis calls run concurrently when falling
+// back from the GraphQL batch path.
+const maxFallbackConcurrency = 8
+
+// reporterAccessLevel is the minimum GitLab access level (>=20, "Reporter") a user must have on a
+// group for that group's membership to grant Read access to the group's (and its subgroups')
+// projects.
+const reporterAccessLevel = 20
+
 var _ authz.Provider = ((*GitLabOAuthAuthzProvider)(nil))
 
 type GitLabOAuthAuthzProvider struct {
@@ -30,6 +48,10 @@ type GitLabOAuthAuthzProvider struct {
 	codeHost       *gitlab.CodeHost
 	cache          cache
 	cacheTTL       time.Duration
+
+	// fetchGroup coalesces concurrent fetchProjVis calls for the same project ID and access token
+	// into one GitLab API request.
+	fetchGroup singleflight.Group
 }
 
 type GitLabOAuthAuthzProviderOp struct {
@@ -39,23 +61,38 @@ type GitLabOAuthAuthzProviderOp struct {
 	// CacheTTL is the TTL of cached permissions lists from the GitLab API.
 	CacheTTL time.Duration
 
+	// LocalCacheSize bounds the number of entries kept in the in-process cache that fronts the
+	// Redis-backed cache. If zero, defaultLocalCacheSize is used.
+	LocalCacheSize int
+
+	// TLSConfig configures how the provider's GitLab client verifies and authenticates TLS
+	// connections. This is required for self-managed GitLab instances that use an internal CA or
+	// require client certificates (mTLS); nil uses the system default.
+	TLSConfig *schema.TLSConfig
+
 	// MockCache, if non-nil, replaces the default Redis-based cache with the supplied cache mock.
-	// Should only be used in tests.
+	// Should only be used in tests. It is used as-is, bypassing the in-process cache tier.
 	MockCache cache
 }
 
-func NewProvider(op GitLabOAuthAuthzProviderOp) *GitLabOAuthAuthzProvider {
+func NewProvider(op GitLabOAuthAuthzProviderOp) (*GitLabOAuthAuthzProvider, error) {
+	httpClient, err := newHTTPClient(op.TLSConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid GitLab TLS config")
+	}
+
 	p := &GitLabOAuthAuthzProvider{
-		clientProvider: gitlab.NewClientProvider(op.BaseURL, nil),
+		clientProvider: gitlab.NewClientProvider(op.BaseURL, httpClient),
 		clientURL:      op.BaseURL,
 		codeHost:       gitlab.NewCodeHost(op.BaseURL),
 		cache:          op.MockCache,
 		cacheTTL:       op.CacheTTL,
 	}
 	if p.cache == nil {
-		p.cache = rcache.NewWithTTL(fmt.Sprintf("gitlabAuthz:%s", op.BaseURL.String()), int(math.Ceil(op.CacheTTL.Seconds())))
+		remote := rcache.NewWithTTL(fmt.Sprintf("gitlabAuthz:%s", op.BaseURL.String()), int(math.Ceil(op.CacheTTL.Seconds())))
+		p.cache = newTwoTierCache(remote, op.LocalCacheSize, op.CacheTTL)
 	}
-	return p
+	return p, nil
 }
 
 func (p *GitLabOAuthAuthzProvider) Validate() (problems []string) {
@@ -102,6 +139,12 @@ func (p *GitLabOAuthAuthzProvider) RepoPerms(ctx context.Context, account *extsv
 			nextRemaining[repo] = struct{}{}
 			continue
 		}
+		if vis.NotFound {
+			// Negatively cached: the project's deletion was confirmed (see
+			// repoVisibilityCacheVal.NotFound), so it confers no perms and there is nothing more
+			// to look up.
+			continue
+		}
 		switch v := vis.Visibility; {
 		case v == gitlab.Public:
 			fallthrough
@@ -146,41 +189,147 @@ func (p *GitLabOAuthAuthzProvider) RepoPerms(ctx context.Context, account *extsv
 		}
 		accessToken = tok.AccessToken
 	}
+
+	// Resolve as much of remaining as possible via the user's group memberships: a project whose
+	// namespace path is underneath a group the user has at least Reporter access to is readable,
+	// without requiring a per-project API call. This is the dominant path for users who belong to
+	// a handful of groups but have access to thousands of projects inside them.
+	if accountID != "" && accessToken != "" {
+		groups, err := p.fetchUserGroups(ctx, accountID, accessToken)
+		if err != nil {
+			log15.Error("Failed to fetch GitLab group memberships", "gitlabHost", p.codeHost.BaseURL().String(), "error", err)
+		} else {
+			for repo := range remaining {
+				namespace := projectNamespacePath(p.codeHost, repo.RepoName)
+				if namespace == "" {
+					continue
+				}
+				if !p.anyGroupIsPrefixOf(groups, namespace) {
+					continue
+				}
+
+				projID, err := strconv.Atoi(repo.ExternalRepoSpec.ID)
+				if err != nil {
+					return nil, errors.Wrap(err, "GitLab repo external ID did not parse to int")
+				}
+
+				perms[repo.RepoName] = map[authz.Perm]bool{authz.Read: true}
+				if err := cacheSetUserRepo(p.cache, accountID, projID, userRepoCacheVal{Read: true, TTL: p.cacheTTL}); err != nil {
+					return nil, errors.Wrap(err, "could not set cached user repo")
+				}
+				delete(remaining, repo)
+			}
+		}
+	}
+
+	projIDs := make([]int, 0, len(remaining))
+	repoByProjID := make(map[int]authz.Repo, len(remaining))
 	for repo := range remaining {
 		projID, err := strconv.Atoi(repo.ExternalRepoSpec.ID)
 		if err != nil {
 			return nil, errors.Wrap(err, "GitLab repo external ID did not parse to int")
 		}
-		isAccessible, vis, err := p.fetchProjVis(ctx, accessToken, projID)
-		if err != nil {
-			log15.Error("Failed to fetch visibility for GitLab project", "projectID", projID, "gitlabHost", p.codeHost.BaseURL().String(), "error", err)
+		projIDs = append(projIDs, projID)
+		repoByProjID[projID] = repo
+	}
+
+	// fetchProjVisBatch returns whatever chunks it resolved before hitting an error, so a single
+	// failed chunk (of possibly many) doesn't throw away every project GraphQL already resolved
+	// and force all of them through the slower REST fallback below.
+	visByProjID, err := p.fetchProjVisBatch(ctx, accessToken, projIDs)
+	if err != nil {
+		log15.Warn("Batch fetch of GitLab project visibility failed, falling back to per-project REST calls for the rest", "gitlabHost", p.codeHost.BaseURL().String(), "error", err)
+	}
+	if visByProjID == nil {
+		visByProjID = map[int]gitlab.Visibility{}
+	}
+
+	nextRemainingProjIDs := make([]int, 0, len(projIDs))
+	for _, projID := range projIDs {
+		if _, ok := visByProjID[projID]; ok {
 			continue
 		}
-		if isAccessible {
-			// Set perms
-			perms[repo.RepoName] = map[authz.Perm]bool{authz.Read: true}
+		nextRemainingProjIDs = append(nextRemainingProjIDs, projID)
+	}
 
-			// Update visibility cache
-			err := cacheSetRepoVisibility(p.cache, projID, repoVisibilityCacheVal{Visibility: vis, TTL: p.cacheTTL})
-			if err != nil {
-				return nil, errors.Wrap(err, "could not set cached repo visibility")
-			}
+	// Fall back to the per-project REST endpoint for anything GraphQL didn't return (GraphQL
+	// unavailable, or a partial result), running the fallback fetches concurrently rather than
+	// serially so a page of cache misses doesn't pay for N sequential round trips.
+	if len(nextRemainingProjIDs) > 0 {
+		var (
+			g       errgroup.Group
+			visMu   sync.Mutex
+			fetched = make(map[int]fetchProjVisResult, len(nextRemainingProjIDs))
+			sem     = make(chan struct{}, maxFallbackConcurrency)
+		)
+		for _, projID := range nextRemainingProjIDs {
+			projID := projID
+			g.Go(func() error {
+				sem <- struct{}{}
+				defer func() { <-sem }()
 
-			// Update userRepo cache if the visibility is private
-			if vis == gitlab.Private {
-				err := cacheSetUserRepo(p.cache, accountID, projID, userRepoCacheVal{Read: true, TTL: p.cacheTTL})
+				isAccessible, notFound, vis, err := p.fetchProjVis(ctx, accessToken, projID)
 				if err != nil {
-					return nil, errors.Wrap(err, "could not set cached user repo")
+					log15.Error("Failed to fetch visibility for GitLab project", "projectID", projID, "gitlabHost", p.codeHost.BaseURL().String(), "error", err)
+					return nil
+				}
+				visMu.Lock()
+				fetched[projID] = fetchProjVisResult{isAccessible: isAccessible, notFound: notFound, vis: vis}
+				visMu.Unlock()
+				return nil
+			})
+		}
+		_ = g.Wait()
+
+		for projID, res := range fetched {
+			if res.notFound {
+				// GitLab returns 404 for a project that's genuinely gone AND for one that exists
+				// but isn't visible to the token making the request — it doesn't distinguish the
+				// two. A 404 under a user's token only tells us that one user can't see the
+				// project, not that nobody can, so record the negative result for this user alone.
+				//
+				// An unauthenticated fetch (accountID=="", accessToken=="") is no safer to
+				// globalize: GitLab also 404s an anonymous GET for internal and private projects,
+				// not only deleted ones, and accountID=="" doesn't mean "no specific user" — a
+				// Sourcegraph user authenticated via SAML/LDAP with no linked GitLab OAuth token
+				// hits this exact path. Caching a global NotFound here would deny every other
+				// user, including ones who do have access, until TTL. Since we cannot distinguish
+				// "deleted" from "not public" without an admin/PAT-authenticated lookup, leave
+				// this case uncached and let it re-resolve on the next request instead.
+				if accountID != "" {
+					if err := cacheSetUserRepo(p.cache, accountID, projID, userRepoCacheVal{Read: false, TTL: p.cacheTTL}); err != nil {
+						return nil, errors.Wrap(err, "could not set cached user repo")
+					}
 				}
+				continue
 			}
-		} else if accountID != "" {
-			// A repo is private if it is not accessible to an authenticated user
-			err := cacheSetRepoVisibility(p.cache, projID, repoVisibilityCacheVal{Visibility: gitlab.Private, TTL: p.cacheTTL})
-			if err != nil {
-				return nil, errors.Wrap(err, "could not set cached repo visibility")
+			if res.isAccessible {
+				visByProjID[projID] = res.vis
+			} else if accountID != "" {
+				// A repo is private if it is not accessible to an authenticated user.
+				if err := cacheSetRepoVisibility(p.cache, projID, repoVisibilityCacheVal{Visibility: gitlab.Private, TTL: p.cacheTTL}); err != nil {
+					return nil, errors.Wrap(err, "could not set cached repo visibility")
+				}
+				if err := cacheSetUserRepo(p.cache, accountID, projID, userRepoCacheVal{Read: false, TTL: p.cacheTTL}); err != nil {
+					return nil, errors.Wrap(err, "could not set cached user repo")
+				}
 			}
-			err = cacheSetUserRepo(p.cache, accountID, projID, userRepoCacheVal{Read: false, TTL: p.cacheTTL})
-			if err != nil {
+		}
+	}
+
+	for projID, vis := range visByProjID {
+		repo, ok := repoByProjID[projID]
+		if !ok {
+			continue
+		}
+
+		perms[repo.RepoName] = map[authz.Perm]bool{authz.Read: true}
+
+		if err := cacheSetRepoVisibility(p.cache, projID, repoVisibilityCacheVal{Visibility: vis, TTL: p.cacheTTL}); err != nil {
+			return nil, errors.Wrap(err, "could not set cached repo visibility")
+		}
+		if vis == gitlab.Private {
+			if err := cacheSetUserRepo(p.cache, accountID, projID, userRepoCacheVal{Read: true, TTL: p.cacheTTL}); err != nil {
 				return nil, errors.Wrap(err, "could not set cached user repo")
 			}
 		}
@@ -188,23 +337,170 @@ func (p *GitLabOAuthAuthzProvider) RepoPerms(ctx context.Context, account *extsv
 	return perms, nil
 }
 
+// WarmCache pre-populates the visibility/user-repo cache for account across repos, via the same
+// batch-then-fallback fetch path RepoPerms itself uses. It is intended to be called by a
+// background syncer so that the steady-state RepoPerms call can be answered entirely from cache.
+func (p *GitLabOAuthAuthzProvider) WarmCache(ctx context.Context, account *extsvc.ExternalAccount, repos map[authz.Repo]struct{}) error {
+	_, err := p.RepoPerms(ctx, account, repos)
+	return err
+}
+
+// InvalidateProject evicts any cached visibility entry for projID, forcing the next RepoPerms call
+// to re-fetch it from GitLab. Used in response to project_destroy/project_rename/project_update
+// system hook events.
+func (p *GitLabOAuthAuthzProvider) InvalidateProject(projID int) {
+	p.cache.Delete(repoVisibilityCacheKey(projID))
+}
+
+// InvalidateUserProject evicts the cached per-user Read decision for (accountID, projID). Used in
+// response to user_add_to_team/user_remove_from_team system hook events.
+func (p *GitLabOAuthAuthzProvider) InvalidateUserProject(accountID string, projID int) {
+	p.cache.Delete(userRepoCacheKey(accountID, projID))
+}
+
+// InvalidateUserGroups evicts the cached group list for accountID, forcing the next RepoPerms call
+// for that user to re-fetch their groups from GitLab instead of trusting a stale list. Used in
+// response to user_add_to_group/user_remove_from_group system hook events.
+func (p *GitLabOAuthAuthzProvider) InvalidateUserGroups(accountID string) {
+	p.cache.Delete(userGroupsCacheKey(accountID))
+}
+
+// fetchProjVisBatch fetches the visibility of up to len(projIDs) projects using GitLab's GraphQL
+// API, which can resolve many projects in a single request (unlike the REST `GET /projects/:id`
+// endpoint that fetchProjVis uses, which is one request per project). projIDs is chunked into
+// groups of maxGraphQLBatchSize. Projects that don't appear in the result (not found, or not
+// accessible to accessToken) are simply absent from the returned map; callers should treat any
+// projID missing from it as needing the REST fallback.
+func (p *GitLabOAuthAuthzProvider) fetchProjVisBatch(ctx context.Context, accessToken string, projIDs []int) (map[int]gitlab.Visibility, error) {
+	client := p.clientProvider.GetOAuthClient(accessToken)
+
+	vis := make(map[int]gitlab.Visibility, len(projIDs))
+	for start := 0; start < len(projIDs); start += maxGraphQLBatchSize {
+		end := start + maxGraphQLBatchSize
+		if end > len(projIDs) {
+			end = len(projIDs)
+		}
+		chunk := projIDs[start:end]
+
+		projs, err := client.ListProjectsByIDsGraphQL(ctx, chunk)
+		if err != nil {
+			// A partial result is still useful (the caller falls back to REST for anything
+			// missing), but if the whole chunk failed there's nothing to merge.
+			return vis, errors.Wrap(err, "GraphQL projects query")
+		}
+		for _, proj := range projs {
+			vis[proj.ID] = proj.Visibility
+		}
+	}
+	return vis, nil
+}
+
+// fetchProjVisResult is the value cached/shared by fetchProjVis's singleflight group.
+type fetchProjVisResult struct {
+	isAccessible bool
+	notFound     bool
+	vis          gitlab.Visibility
+}
+
 // fetchRepoVisibility fetches a repository's visibility with usr's credentials. It returns whether
-// the repo is accessible to the user, the visibility if the repo is accessible (otherwise this is
-// empty), and any error encountered in fetching (not including an error due to the repository not
-// being visible).
+// the repo is accessible to the user, whether GitLab reported the project as not found (a 404,
+// which RepoPerms caches as a Read:false result for the requesting account only, and leaves
+// uncached when there is no account), the visibility if the
+// repo is accessible (otherwise this is empty), and any error encountered in fetching (not
+// including an error due to the repository not being visible).
+//
+// Concurrent calls for the same (projID, accessToken) are coalesced into a single GitLab API
+// request. The access token is part of the coalescing key — GET /projects/:id is authorized per
+// token, so two different users' concurrent requests for the same project must never share a
+// single GitLab response; doing so would leak the winning user's access to the other, or wrongly
+// deny the other user based on the winner's lack of access.
 func (p *GitLabOAuthAuthzProvider) fetchProjVis(ctx context.Context, accessToken string, projID int) (
-	isAccessible bool, vis gitlab.Visibility, err error,
+	isAccessible bool, notFound bool, vis gitlab.Visibility, err error,
 ) {
 	log.Printf("# fetchProjVis %d", projID)
 	// TODO(beyang): bypass cache (gitlab client is cached) // NEXT
 
-	proj, err := p.clientProvider.GetOAuthClient(accessToken).GetProject(ctx, projID, "")
+	groupKey := strconv.Itoa(projID) + ":" + accessToken
+	v, err, shared := p.fetchGroup.Do(groupKey, func() (interface{}, error) {
+		proj, err := p.clientProvider.GetOAuthClient(accessToken).GetProject(ctx, projID, "")
+		if err != nil {
+			if errCode := gitlab.HTTPErrorCode(err); errCode == http.StatusNotFound {
+				return fetchProjVisResult{notFound: true}, nil
+			}
+			return nil, err
+		}
+		return fetchProjVisResult{isAccessible: true, vis: proj.Visibility}, nil
+	})
+	if shared {
+		cacheOpsCounter.WithLabelValues("singleflight", "coalesced").Inc()
+	}
 	if err != nil {
-		if errCode := gitlab.HTTPErrorCode(err); errCode == http.StatusNotFound {
-			return false, "", nil
+		return false, false, "", err
+	}
+	res := v.(fetchProjVisResult)
+	return res.isAccessible, res.notFound, res.vis, nil
+}
+
+// fetchUserGroups enumerates every group the user has at least Reporter access to, including
+// subgroups reached transitively through the group hierarchy, by consulting the cached group list
+// for accountID before falling back to GitLab's /groups endpoint.
+//
+// Note this only covers projects reachable through a group namespace. Personal-namespace projects
+// (e.g. host/alice/proj, via GitLab's /users/:id/projects) are not enumerated here and so fall
+// through to the per-project/batch visibility fetch below, same as before this provider existed.
+func (p *GitLabOAuthAuthzProvider) fetchUserGroups(ctx context.Context, accountID, accessToken string) ([]*gitlab.Group, error) {
+	if groups, exists := cacheGetUserGroups(p.cache, accountID, p.cacheTTL); exists {
+		return groups, nil
+	}
+
+	client := p.clientProvider.GetOAuthClient(accessToken)
+
+	var groups []*gitlab.Group
+	page := 1
+	for {
+		batch, hasNextPage, err := client.ListGroups(ctx, gitlab.ListGroupsOptions{
+			Page:           page,
+			PerPage:        100,
+			MinAccessLevel: reporterAccessLevel,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "list GitLab groups")
+		}
+		groups = append(groups, batch...)
+
+		if !hasNextPage {
+			break
 		}
-		return false, "", err
+		page++
 	}
 
-	return true, proj.Visibility, nil
+	if err := cacheSetUserGroups(p.cache, accountID, userGroupsCacheVal{Groups: groups, TTL: p.cacheTTL}); err != nil {
+		return nil, errors.Wrap(err, "could not set cached user groups")
+	}
+	return groups, nil
+}
+
+// anyGroupIsPrefixOf reports whether namespace (a project's namespace path, e.g. "acme/backend")
+// is the group's path or a subgroup underneath it, for any of groups. GitLab subgroup paths are
+// always prefixed by their ancestor group's path (e.g. "acme/backend/payments"), so this correctly
+// grants access to projects in inherited subgroups without enumerating them individually.
+func (p *GitLabOAuthAuthzProvider) anyGroupIsPrefixOf(groups []*gitlab.Group, namespace string) bool {
+	for _, group := range groups {
+		if namespace == group.FullPath || strings.HasPrefix(namespace, group.FullPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// projectNamespacePath extracts a GitLab project's namespace path (everything but the last path
+// component) from its Sourcegraph repo name, e.g. "gitlab.example.com/acme/backend/payments" ->
+// "acme/backend".
+func projectNamespacePath(codeHost *gitlab.CodeHost, repoName api.RepoName) string {
+	trimmed := strings.TrimPrefix(string(repoName), codeHost.BaseURL().Host+"/")
+	i := strings.LastIndex(trimmed, "/")
+	if i <= 0 {
+		return ""
+	}
+	return trimmed[:i]
 }
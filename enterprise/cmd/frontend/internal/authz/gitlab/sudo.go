@@ -0,0 +1,213 @@
+package gitlab
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/types"
+	"github.com/sourcegraph/sourcegraph/pkg/api"
+	"github.com/sourcegraph/sourcegraph/pkg/extsvc"
+	"github.com/sourcegraph/sourcegraph/pkg/extsvc/gitlab"
+	"github.com/sourcegraph/sourcegraph/pkg/rcache"
+	"github.com/sourcegraph/sourcegraph/schema"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ authz.Provider = ((*GitLabSudoAuthzProvider)(nil))
+
+// GitLabSudoAuthzProvider answers permissions checks using a single admin personal access token,
+// impersonating each user via GitLab's Sudo API, instead of the per-user OAuth token that
+// GitLabOAuthAuthzProvider requires. This is the only option for deployments where users
+// authenticate to Sourcegraph via SAML/LDAP, since no GitLab OAuth token exists for them in that
+// case.
+type GitLabSudoAuthzProvider struct {
+	clientProvider *gitlab.ClientProvider
+	clientURL      *url.URL
+	codeHost       *gitlab.CodeHost
+	cache          cache
+	cacheTTL       time.Duration
+
+	// sudoToken is the admin personal access token used to impersonate users via Sudo.
+	sudoToken string
+
+	// identityMapper maps an external SSO identity (e.g. a SAML NameID) to the GitLab username or
+	// numeric user ID to impersonate.
+	identityMapper IdentityMapper
+}
+
+// IdentityMapper maps an external account to the GitLab username or user ID GitLab should
+// impersonate when the admin token makes a Sudo request on that user's behalf.
+type IdentityMapper interface {
+	GitLabIdentity(ctx context.Context, account *extsvc.ExternalAccount) (usernameOrID string, err error)
+}
+
+// externalAccountIdentityMapper maps an external account directly to the GitLab username, for
+// deployments where the SSO provider's user identifier is already the GitLab username (e.g. a
+// SAML NameID synced to match GitLab usernames).
+type externalAccountIdentityMapper struct {
+	// serviceID restricts mapping to external accounts from this SSO provider, e.g. a SAML or
+	// OpenID Connect provider's ID, so that accounts from unrelated providers are not mapped.
+	serviceID string
+}
+
+func (m *externalAccountIdentityMapper) GitLabIdentity(ctx context.Context, account *extsvc.ExternalAccount) (string, error) {
+	if account == nil || account.ServiceID != m.serviceID {
+		return "", nil
+	}
+	return account.AccountID, nil
+}
+
+func newIdentityMapper(idp *schema.GitLabAuthzIdentityProvider) (IdentityMapper, error) {
+	if idp == nil {
+		return nil, errors.New("identityProvider is required for GitLab Sudo authorization")
+	}
+	return &externalAccountIdentityMapper{serviceID: idp.ServiceID}, nil
+}
+
+type GitLabSudoAuthzProviderOp struct {
+	// BaseURL is the URL of the GitLab instance.
+	BaseURL *url.URL
+
+	// SudoToken is the admin personal access token used for Sudo-impersonated API calls.
+	SudoToken string
+
+	// IdentityMapper resolves a Sourcegraph external account to the GitLab identity to impersonate.
+	IdentityMapper IdentityMapper
+
+	// CacheTTL is the TTL of the cached per-user accessible-project sets.
+	CacheTTL time.Duration
+
+	// TLSConfig configures how the provider's GitLab client verifies and authenticates TLS
+	// connections. This is required for self-managed GitLab instances that use an internal CA or
+	// require client certificates (mTLS); nil uses the system default.
+	TLSConfig *schema.TLSConfig
+
+	// MockCache, if non-nil, replaces the default Redis-based cache with the supplied cache mock.
+	// Should only be used in tests.
+	MockCache cache
+}
+
+func NewSudoProvider(op GitLabSudoAuthzProviderOp) (*GitLabSudoAuthzProvider, error) {
+	httpClient, err := newHTTPClient(op.TLSConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid GitLab TLS config")
+	}
+
+	p := &GitLabSudoAuthzProvider{
+		clientProvider: gitlab.NewClientProvider(op.BaseURL, httpClient),
+		clientURL:      op.BaseURL,
+		codeHost:       gitlab.NewCodeHost(op.BaseURL),
+		cache:          op.MockCache,
+		cacheTTL:       op.CacheTTL,
+		sudoToken:      op.SudoToken,
+		identityMapper: op.IdentityMapper,
+	}
+	if p.cache == nil {
+		p.cache = rcache.NewWithTTL(fmt.Sprintf("gitlabSudoAuthz:%s", op.BaseURL.String()), int(math.Ceil(op.CacheTTL.Seconds())))
+	}
+	return p, nil
+}
+
+func (p *GitLabSudoAuthzProvider) Validate() (problems []string) {
+	if p.sudoToken == "" {
+		problems = append(problems, "sudoToken must be set")
+	}
+	if p.identityMapper == nil {
+		problems = append(problems, "identityMapper must be set")
+	}
+	return problems
+}
+
+func (p *GitLabSudoAuthzProvider) ServiceID() string {
+	return p.codeHost.ServiceID()
+}
+
+func (p *GitLabSudoAuthzProvider) ServiceType() string {
+	return p.codeHost.ServiceType()
+}
+
+func (p *GitLabSudoAuthzProvider) Repos(ctx context.Context, repos map[authz.Repo]struct{}) (mine map[authz.Repo]struct{}, others map[authz.Repo]struct{}) {
+	return authz.GetCodeHostRepos(p.codeHost, repos)
+}
+
+func (p *GitLabSudoAuthzProvider) FetchAccount(ctx context.Context, user *types.User, current []*extsvc.ExternalAccount) (mine *extsvc.ExternalAccount, err error) {
+	return nil, nil
+}
+
+func (p *GitLabSudoAuthzProvider) RepoPerms(ctx context.Context, account *extsvc.ExternalAccount, repos map[authz.Repo]struct{}) (
+	map[api.RepoName]map[authz.Perm]bool, error,
+) {
+	perms := map[api.RepoName]map[authz.Perm]bool{}
+	mine, _ := p.Repos(ctx, repos)
+	if account == nil {
+		return perms, nil
+	}
+
+	sudo, err := p.identityMapper.GitLabIdentity(ctx, account)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not resolve GitLab identity for Sudo impersonation")
+	}
+	if sudo == "" {
+		return perms, nil
+	}
+
+	projIDs, exists := cacheGetSudoUserProjects(p.cache, sudo, p.cacheTTL)
+	if !exists {
+		projIDs, err = p.fetchSudoUserProjects(ctx, sudo)
+		if err != nil {
+			log15.Error("Failed to fetch GitLab projects via Sudo", "gitlabHost", p.codeHost.BaseURL().String(), "sudo", sudo, "error", err)
+			return perms, nil
+		}
+		if err := cacheSetSudoUserProjects(p.cache, sudo, sudoUserProjectsCacheVal{ProjectIDs: projIDs, TTL: p.cacheTTL}); err != nil {
+			return nil, errors.Wrap(err, "could not set cached Sudo user projects")
+		}
+	}
+
+	accessible := make(map[int]struct{}, len(projIDs))
+	for _, id := range projIDs {
+		accessible[id] = struct{}{}
+	}
+
+	for repo := range mine {
+		projID, err := strconv.Atoi(repo.ExternalRepoSpec.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "GitLab repo external ID did not parse to int")
+		}
+		if _, ok := accessible[projID]; ok {
+			perms[repo.RepoName] = map[authz.Perm]bool{authz.Read: true}
+		}
+	}
+	return perms, nil
+}
+
+// fetchSudoUserProjects fetches, in one paginated pass, the full list of project IDs the given
+// GitLab user (impersonated via Sudo) can see.
+func (p *GitLabSudoAuthzProvider) fetchSudoUserProjects(ctx context.Context, sudo string) ([]int, error) {
+	client := p.clientProvider.GetPATClient(p.sudoToken, sudo)
+
+	var projIDs []int
+	page := 1
+	for {
+		projs, hasNextPage, err := client.ListProjects(ctx, gitlab.ListProjectsOptions{
+			Page:    page,
+			PerPage: 100,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "list GitLab projects via Sudo")
+		}
+		for _, proj := range projs {
+			projIDs = append(projIDs, proj.ID)
+		}
+		if !hasNextPage {
+			break
+		}
+		page++
+	}
+	return projIDs, nil
+}
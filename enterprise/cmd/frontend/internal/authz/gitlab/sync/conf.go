@@ -0,0 +1,135 @@
+package sync
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/db"
+	gitlabauthz "github.com/sourcegraph/sourcegraph/enterprise/cmd/frontend/internal/authz/gitlab"
+	"github.com/sourcegraph/sourcegraph/pkg/conf"
+	"github.com/sourcegraph/sourcegraph/pkg/extsvc"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// syncInterval is how often a PermsSyncer re-warms its provider's cache once the steady state is
+// reached, matching the request's "answer entirely from cache in the steady state" goal.
+const syncInterval = 5 * time.Minute
+
+// hostSyncer pairs a running PermsSyncer with the webhook secret token configured for its GitLab
+// host, so a single shared /.api/gitlab-webhook endpoint can dispatch an incoming system hook
+// event to the right host's syncer by matching its secret token.
+type hostSyncer struct {
+	secretToken string
+	syncer      *PermsSyncer
+}
+
+var (
+	mu       sync.Mutex
+	running  []hostSyncer
+	stopPrev context.CancelFunc = func() {}
+)
+
+func init() {
+	conf.Watch(reload)
+}
+
+// reload replaces every running PermsSyncer with a fresh set built from the latest config. This
+// mirrors parseSudoConfig's own reactive rebuild-from-scratch approach in conf.go rather than
+// diffing the old and new provider sets, since GitLab authz config changes are rare.
+func reload() {
+	providers, problems := gitlabauthz.ConfiguredProviders(conf.Get())
+	for _, problem := range problems {
+		log15.Warn("Invalid GitLab authz config, skipping perms sync for this entry", "problem", problem)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	mu.Lock()
+	stopPrev()
+	stopPrev = cancel
+	next := make([]hostSyncer, 0, len(providers))
+	for _, cp := range providers {
+		s := NewPermsSyncer(
+			cp.Provider,
+			syncInterval,
+			listAccounts(cp.ServiceType, cp.ServiceID),
+			listRepos(cp.ServiceID),
+			accountForGitLabUserID(cp.ServiceType, cp.ServiceID),
+		)
+		go s.Run(ctx)
+		next = append(next, hostSyncer{secretToken: cp.WebhookSecret, syncer: s})
+	}
+	running = next
+	mu.Unlock()
+}
+
+// Handler returns the HTTP handler to mount at /.api/gitlab-webhook in the frontend's route
+// table. It dispatches an incoming GitLab system hook request to whichever configured host's
+// PermsSyncer has a matching webhook secret token, since multiple GitLab external services (each
+// with its own system hook secret) can share this one endpoint.
+//
+// This is the extension point the frontend's server setup (outside this package, and not present
+// in this checkout) must call at startup, e.g. `mux.Handle("/.api/gitlab-webhook", sync.Handler())`.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := []byte(r.Header.Get("X-Gitlab-Token"))
+
+		mu.Lock()
+		current := running
+		mu.Unlock()
+
+		for _, hs := range current {
+			if hs.secretToken == "" || subtle.ConstantTimeCompare(token, []byte(hs.secretToken)) != 1 {
+				continue
+			}
+			NewWebhookHandler(hs.syncer, hs.secretToken).ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, "invalid or missing X-Gitlab-Token", http.StatusUnauthorized)
+	})
+}
+
+func listAccounts(serviceType, serviceID string) func(ctx context.Context) ([]*extsvc.ExternalAccount, error) {
+	return func(ctx context.Context) ([]*extsvc.ExternalAccount, error) {
+		return db.ExternalAccounts.List(ctx, db.ExternalAccountsListOptions{
+			ServiceType: serviceType,
+			ServiceID:   serviceID,
+		})
+	}
+}
+
+func listRepos(serviceID string) func(ctx context.Context) (map[authz.Repo]struct{}, error) {
+	return func(ctx context.Context) (map[authz.Repo]struct{}, error) {
+		rs, err := db.Repos.List(ctx, db.ReposListOptions{ExternalServiceID: serviceID})
+		if err != nil {
+			return nil, err
+		}
+		repos := make(map[authz.Repo]struct{}, len(rs))
+		for _, r := range rs {
+			repos[authz.Repo{RepoName: r.Name, ExternalRepoSpec: r.ExternalRepo}] = struct{}{}
+		}
+		return repos, nil
+	}
+}
+
+func accountForGitLabUserID(serviceType, serviceID string) func(ctx context.Context, gitlabUserID int) (string, error) {
+	return func(ctx context.Context, gitlabUserID int) (string, error) {
+		accounts, err := db.ExternalAccounts.List(ctx, db.ExternalAccountsListOptions{
+			ServiceType: serviceType,
+			ServiceID:   serviceID,
+			AccountID:   strconv.Itoa(gitlabUserID),
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(accounts) == 0 {
+			return "", nil
+		}
+		return accounts[0].AccountID, nil
+	}
+}
@@ -0,0 +1,98 @@
+// Package sync implements a background perms-sync worker for the GitLab authz provider, so that
+// GitLabOAuthAuthzProvider.RepoPerms can answer from cache in the steady state instead of every
+// post-TTL-expiry search blocking on a burst of GitLab API calls.
+package sync
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/sourcegraph/cmd/frontend/authz"
+	"github.com/sourcegraph/sourcegraph/enterprise/cmd/frontend/internal/authz/gitlab"
+	"github.com/sourcegraph/sourcegraph/pkg/extsvc"
+	"golang.org/x/sync/errgroup"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// maxSyncConcurrency bounds how many accounts' caches are warmed concurrently, so that one
+// slow-to-respond account can't serialize and delay the sync cycle for every other account.
+const maxSyncConcurrency = 8
+
+// PermsSyncer periodically pre-warms a GitLabOAuthAuthzProvider's cache for every known GitLab
+// external account, and exposes OnWebhook for incremental invalidation driven by GitLab system
+// hooks in between sync intervals.
+type PermsSyncer struct {
+	provider *gitlab.GitLabOAuthAuthzProvider
+	interval time.Duration
+
+	// ListAccounts returns every GitLab external account to warm the cache for.
+	ListAccounts func(ctx context.Context) ([]*extsvc.ExternalAccount, error)
+
+	// ListRepos returns the set of repos backed by this GitLab instance to check perms for.
+	ListRepos func(ctx context.Context) (map[authz.Repo]struct{}, error)
+
+	// AccountForGitLabUserID resolves a GitLab user ID (as seen in a system hook payload) back to
+	// the Sourcegraph external account ID used as the cache key, for invalidating exactly the
+	// affected (userID, projID) entry on membership-change webhooks.
+	AccountForGitLabUserID func(ctx context.Context, gitlabUserID int) (accountID string, err error)
+}
+
+// NewPermsSyncer constructs a PermsSyncer for provider, pre-warming its cache every interval.
+func NewPermsSyncer(
+	provider *gitlab.GitLabOAuthAuthzProvider,
+	interval time.Duration,
+	listAccounts func(ctx context.Context) ([]*extsvc.ExternalAccount, error),
+	listRepos func(ctx context.Context) (map[authz.Repo]struct{}, error),
+	accountForGitLabUserID func(ctx context.Context, gitlabUserID int) (string, error),
+) *PermsSyncer {
+	return &PermsSyncer{
+		provider:               provider,
+		interval:               interval,
+		ListAccounts:           listAccounts,
+		ListRepos:              listRepos,
+		AccountForGitLabUserID: accountForGitLabUserID,
+	}
+}
+
+// Run pre-warms the cache on every tick of s.interval until ctx is canceled.
+func (s *PermsSyncer) Run(ctx context.Context) {
+	for {
+		if err := s.syncAll(ctx); err != nil {
+			log15.Error("GitLab perms sync failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+func (s *PermsSyncer) syncAll(ctx context.Context) error {
+	accounts, err := s.ListAccounts(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list GitLab external accounts")
+	}
+
+	repos, err := s.ListRepos(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list GitLab repos")
+	}
+
+	var g errgroup.Group
+	sem := make(chan struct{}, maxSyncConcurrency)
+	for _, account := range accounts {
+		account := account
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if err := s.provider.WarmCache(ctx, account, repos); err != nil {
+				log15.Error("Failed to warm GitLab perms cache for account", "accountID", account.AccountID, "error", err)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
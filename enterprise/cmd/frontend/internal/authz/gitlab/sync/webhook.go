@@ -0,0 +1,114 @@
+package sync
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+	log15 "gopkg.in/inconshreveable/log15.v2"
+)
+
+// WebhookEvent is the subset of a GitLab system hook payload (https://docs.gitlab.com/ee/system_hooks/)
+// that PermsSyncer acts on.
+type WebhookEvent struct {
+	EventName string `json:"event_name"`
+
+	// ProjectID is set on project_create, project_destroy, project_rename, and project_update
+	// events.
+	ProjectID int `json:"project_id"`
+
+	// UserID is set on user_add_to_team, user_remove_from_team, user_add_to_group, and
+	// user_remove_from_group events; it is the GitLab user ID being added to or removed from the
+	// project (ProjectID) or group (GroupID).
+	UserID int `json:"user_id"`
+
+	// GroupID is set on user_add_to_group and user_remove_from_group events.
+	GroupID int `json:"group_id"`
+}
+
+// OnWebhook invalidates or refreshes exactly the (userID, projID) cache entries affected by a
+// GitLab system hook event, so the steady-state cache stays correct between full sync intervals.
+func (s *PermsSyncer) OnWebhook(ctx context.Context, event WebhookEvent) error {
+	switch event.EventName {
+	case "project_destroy", "project_rename", "project_update":
+		s.provider.InvalidateProject(event.ProjectID)
+
+		// The global visibility entry above covers the common case, but a rename/update can also
+		// move a project across groups or flip its visibility, which changes the Read decision
+		// cached per user via the group-prefix path. There's no reverse index from projID to the
+		// accountIDs that cached a decision for it, so re-derive that set from the known account
+		// list instead of leaving those entries to expire on their own TTL.
+		accounts, err := s.ListAccounts(ctx)
+		if err != nil {
+			return errors.Wrap(err, "list GitLab external accounts")
+		}
+		for _, account := range accounts {
+			s.provider.InvalidateUserProject(account.AccountID, event.ProjectID)
+		}
+
+	case "user_add_to_team", "user_remove_from_team":
+		accountID, err := s.AccountForGitLabUserID(ctx, event.UserID)
+		if err != nil {
+			return err
+		}
+		if accountID == "" {
+			// No Sourcegraph account is linked to this GitLab user; nothing is cached for them.
+			return nil
+		}
+		s.provider.InvalidateUserProject(accountID, event.ProjectID)
+
+	case "user_add_to_group", "user_remove_from_group":
+		// Evicting the cached group list forces the next RepoPerms call for this user to
+		// re-resolve their groups instead of trusting a stale list. Any per-project Read:true
+		// entries the user already picked up via the group-prefix match still expire on their
+		// own TTL, so removal from a group takes up to cacheTTL to take full effect here, same
+		// as every other perms check in this provider.
+		accountID, err := s.AccountForGitLabUserID(ctx, event.UserID)
+		if err != nil {
+			return err
+		}
+		if accountID == "" {
+			return nil
+		}
+		s.provider.InvalidateUserGroups(accountID)
+
+	case "project_create":
+		// Nothing is cached yet for a brand-new project; the next RepoPerms call fetches it.
+
+	default:
+		log15.Debug("Ignoring unhandled GitLab system hook event", "eventName", event.EventName)
+	}
+	return nil
+}
+
+// NewWebhookHandler returns the per-host HTTP handler that Handler dispatches /.api/gitlab-webhook
+// requests to, which decodes an incoming GitLab system hook payload and dispatches it to
+// s.OnWebhook. secretToken must match the
+// "Secret Token" configured on the GitLab system hook (sent back as the X-Gitlab-Token header);
+// requests that don't present it are rejected, since this endpoint can otherwise be used by
+// anyone who can reach it to force mass cache eviction and a GitLab API refetch storm.
+func NewWebhookHandler(s *PermsSyncer, secretToken string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if secretToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secretToken)) != 1 {
+			http.Error(w, "invalid or missing X-Gitlab-Token", http.StatusUnauthorized)
+			return
+		}
+
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, "malformed GitLab system hook payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.OnWebhook(r.Context(), event); err != nil {
+			log15.Error("Failed to handle GitLab system hook event", "eventName", event.EventName, "projectID", strconv.Itoa(event.ProjectID), "error", err)
+			http.Error(w, "failed to handle webhook event", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
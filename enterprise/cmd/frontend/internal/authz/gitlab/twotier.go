@@ -0,0 +1,111 @@
+package gitlab
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var cacheOpsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "src",
+	Subsystem: "gitlab_authz",
+	Name:      "cache_ops_total",
+	Help:      "Number of GitLab authz cache operations, by tier and result.",
+}, []string{"tier", "result"})
+
+// defaultLocalCacheSize is used when GitLabOAuthAuthzProviderOp.LocalCacheSize is unset.
+const defaultLocalCacheSize = 10000
+
+// localTTLCache is a bounded, in-process cache fronting the Redis-backed cache. It trades a small
+// amount of staleness for avoiding a network round trip on every permissions check, which matters
+// for searches that touch thousands of repos.
+type localTTLCache struct {
+	mu  sync.Mutex
+	lru *lru.Cache
+	ttl time.Duration
+}
+
+type localCacheEntry struct {
+	val       []byte
+	expiresAt time.Time
+}
+
+func newLocalTTLCache(size int, ttl time.Duration) *localTTLCache {
+	if size <= 0 {
+		size = defaultLocalCacheSize
+	}
+	l, _ := lru.New(size)
+	return &localTTLCache{lru: l, ttl: ttl}
+}
+
+func (c *localTTLCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	entry := v.(localCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.lru.Remove(key)
+		return nil, false
+	}
+	return entry.val, true
+}
+
+func (c *localTTLCache) Set(key string, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Add(key, localCacheEntry{val: b, expiresAt: time.Now().Add(c.ttl)})
+}
+
+func (c *localTTLCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Remove(key)
+}
+
+// twoTierCache is a cache implementation that serves reads from an in-process localTTLCache,
+// falling back to (and populating from) a remote cache on miss. Writes go through both tiers.
+type twoTierCache struct {
+	local  *localTTLCache
+	remote cache
+}
+
+func newTwoTierCache(remote cache, localCacheSize int, localTTL time.Duration) *twoTierCache {
+	return &twoTierCache{
+		local:  newLocalTTLCache(localCacheSize, localTTL),
+		remote: remote,
+	}
+}
+
+func (c *twoTierCache) Get(key string) ([]byte, bool) {
+	if b, ok := c.local.Get(key); ok {
+		cacheOpsCounter.WithLabelValues("local", "hit").Inc()
+		return b, true
+	}
+	cacheOpsCounter.WithLabelValues("local", "miss").Inc()
+
+	b, ok := c.remote.Get(key)
+	if !ok {
+		cacheOpsCounter.WithLabelValues("remote", "miss").Inc()
+		return nil, false
+	}
+	cacheOpsCounter.WithLabelValues("remote", "hit").Inc()
+	c.local.Set(key, b)
+	return b, true
+}
+
+func (c *twoTierCache) Set(key string, b []byte) {
+	c.local.Set(key, b)
+	c.remote.Set(key, b)
+}
+
+func (c *twoTierCache) Delete(key string) {
+	c.local.Delete(key)
+	c.remote.Delete(key)
+}
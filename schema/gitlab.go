@@ -0,0 +1,77 @@
+package schema
+
+// GitLabConnection is the config shape for a GitLab external service, mirroring
+// schema/gitlab.schema.json.
+type GitLabConnection struct {
+	// Url is the URL of the GitLab instance.
+	Url string `json:"url"`
+
+	// Token is a GitLab personal access token used for non-authz API requests (e.g. repo listing).
+	Token string `json:"token"`
+
+	// Authorization configures how Sourcegraph determines each user's repository permissions on
+	// this GitLab instance. If unset, the default is per-user OAuth token checks.
+	Authorization *GitLabAuthorization `json:"authorization,omitempty"`
+
+	// Tls configures how the GitLab client verifies and authenticates TLS connections to this
+	// instance, for self-managed instances using an internal CA or requiring client certificates.
+	Tls *TLSConfig `json:"tls,omitempty"`
+
+	// Webhooks configures incremental cache invalidation driven by this instance's GitLab system
+	// hooks, delivered to the frontend's /.api/gitlab-webhook endpoint.
+	Webhooks *GitLabWebhooksConfig `json:"webhooks,omitempty"`
+}
+
+// GitLabWebhooksConfig configures the GitLab system hook webhook for one GitLab external service.
+type GitLabWebhooksConfig struct {
+	// Secret is the "Secret Token" configured on the GitLab system hook, sent back as the
+	// X-Gitlab-Token header on every webhook request and used to authenticate it.
+	Secret string `json:"secret"`
+}
+
+// GitLabAuthorization selects and configures a GitLab authorization (permission-sync) mode.
+type GitLabAuthorization struct {
+	// Sudo, if set, switches to the Sudo/impersonation-token authorization mode: RepoPerms is
+	// answered using a single admin personal access token to impersonate each user via GitLab's
+	// Sudo API, instead of requiring a per-user OAuth token. This is the only option for
+	// deployments where users authenticate via SAML/LDAP, since no GitLab OAuth token exists for
+	// them in that case.
+	Sudo *GitLabAuthzSudo `json:"sudo,omitempty"`
+}
+
+// GitLabAuthzSudo configures GitLab Sudo/impersonation-token authorization.
+type GitLabAuthzSudo struct {
+	// Token is the admin personal access token used for Sudo-impersonated API calls.
+	Token string `json:"token"`
+
+	// IdentityProvider resolves a Sourcegraph external account to the GitLab identity to
+	// impersonate.
+	IdentityProvider *GitLabAuthzIdentityProvider `json:"identityProvider"`
+
+	// Ttl is the TTL, as a Go duration string (e.g. "3h"), of the cached per-user accessible-
+	// project sets. Defaults to 3h if empty or invalid.
+	Ttl string `json:"ttl,omitempty"`
+}
+
+// GitLabAuthzIdentityProvider maps an external SSO identity to the GitLab identity GitLab should
+// impersonate when a Sudo-mode provider makes a request on a user's behalf.
+type GitLabAuthzIdentityProvider struct {
+	// ServiceID is the external account service ID (e.g. a SAML or OpenID Connect provider's ID)
+	// whose AccountID should be used directly as the GitLab username to impersonate.
+	ServiceID string `json:"serviceID"`
+}
+
+// TLSConfig configures how a code host client verifies and authenticates TLS connections.
+type TLSConfig struct {
+	// CertificateAuthority is an inline PEM-encoded CA bundle to trust. When set, it replaces the
+	// system roots: only certificates in this bundle are trusted.
+	CertificateAuthority string `json:"certificateAuthority,omitempty"`
+
+	// ClientCertificate and ClientKey are an inline PEM-encoded client certificate/key pair used
+	// for mutual TLS. Both must be set, or both left empty.
+	ClientCertificate string `json:"clientCertificate,omitempty"`
+	ClientKey         string `json:"clientKey,omitempty"`
+
+	// InsecureSkipVerify disables TLS certificate verification. Only use for local development.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}